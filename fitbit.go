@@ -2,7 +2,14 @@ package fitbit
 
 import (
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
 	"io/ioutil"
+	"math/rand"
 	"net/http"
 	"net/url"
 	"strconv"
@@ -21,6 +28,17 @@ const (
 	fitbitTokenURL = "https://api.fitbit.com/oauth2/token"
 )
 
+// Defaults that New assigns to Session.MaxRetries / Session.RetryBaseDelay,
+// and that a negative value of either field falls back to.
+const (
+	defaultMaxRetries     = 3
+	defaultRetryBaseDelay = 500 * time.Millisecond
+)
+
+// errInvalidState is returned by ExchangeRequest when the state parameter is
+// missing, malformed, or fails signature verification.
+var errInvalidState = errors.New("fitbit: invalid oauth state")
+
 // Scope describes an oauth2 scope for Fitbit
 type Scope = string
 
@@ -45,6 +63,18 @@ type Session struct {
 	// HookTokenChange is a function that is called when the refresh_token changes
 	TokenChange func(token *oauth2.Token)
 
+	// MaxRetries is the number of times a request is retried after a 429 or
+	// 5xx response before giving up. New initializes this to defaultMaxRetries;
+	// set it explicitly (including to 0, to disable retries entirely) to
+	// override. A negative value is treated as unset and falls back to
+	// defaultMaxRetries.
+	MaxRetries int
+
+	// RetryBaseDelay is the base delay used for the exponential backoff
+	// between retries. New initializes this to defaultRetryBaseDelay; a
+	// negative value is treated as unset and falls back to it.
+	RetryBaseDelay time.Duration
+
 	ratelimit Ratelimit
 
 	// config is the configuration for this session
@@ -68,6 +98,11 @@ type Config struct {
 	ClientSecret string
 	RedirectURL  string
 	Scopes       []Scope
+
+	// HTTPClient is the base client the OAuth transport wraps. When nil,
+	// http.DefaultClient is used. Set this to integrate with environments
+	// like App Engine's urlfetch, custom TLS configuration, or tracing.
+	HTTPClient *http.Client
 }
 
 // Ratelimit includes the rate limit information provided on every request
@@ -92,8 +127,10 @@ func New(config Config) *Session {
 
 	// return session
 	return &Session{
-		config:      config,
-		oAuthConfig: oAuthConfig,
+		config:         config,
+		oAuthConfig:    oAuthConfig,
+		MaxRetries:     defaultMaxRetries,
+		RetryBaseDelay: defaultRetryBaseDelay,
 	}
 }
 
@@ -102,6 +139,26 @@ func (m *Session) LoginURL(csrf string) string {
 	return m.oAuthConfig.AuthCodeURL(csrf, oauth2.AccessTypeOffline)
 }
 
+// LoginURLFor returns an OAuth login url whose state parameter is an
+// HMAC-signed encoding of userID, so that ExchangeRequest can later recover
+// and authenticate userID from the redirect alone. This allows a single
+// callback endpoint to multiplex OAuth grants for many users without an
+// external session store.
+func (m *Session) LoginURLFor(userID string) string {
+	return m.oAuthConfig.AuthCodeURL(m.signState(userID), oauth2.AccessTypeOffline)
+}
+
+// signState builds the "base64(userID)|signature" state value used by
+// LoginURLFor. userID is base64-encoded before the delimiter is appended so
+// a userID containing "|" can never be confused with the delimiter when
+// ExchangeRequest splits the state back apart.
+func (m *Session) signState(userID string) string {
+	encodedUserID := base64.RawURLEncoding.EncodeToString([]byte(userID))
+	mac := hmac.New(sha256.New, []byte(m.config.ClientSecret))
+	mac.Write([]byte(encodedUserID))
+	return encodedUserID + "|" + hex.EncodeToString(mac.Sum(nil))
+}
+
 // cacherTransport is a transport which intercepts RoundTrip to check if the token changed on HTTP requests
 type cacherTransport struct {
 	Base    *oauth2.Transport
@@ -147,17 +204,37 @@ func (c *cacherTransport) RoundTrip(req *http.Request) (resp *http.Response, err
 }
 
 // Like oauth2.Config.Client(), but using cacherTransport to persist tokens.
+// The client is cached for the lifetime of the Session, so it is always
+// built against context.Background() rather than a single caller's request
+// ctx; per-request cancellation is applied separately in Do via
+// http.NewRequestWithContext.
 func (m *Session) newHTTPClient() *http.Client {
+	ctx := context.Background()
+	if m.config.HTTPClient != nil {
+		ctx = context.WithValue(ctx, oauth2.HTTPClient, m.config.HTTPClient)
+	}
+	source := m.oAuthConfig.TokenSource(ctx, m.token)
+	base := oauth2.NewClient(ctx, source).Transport.(*oauth2.Transport)
+
 	return &http.Client{
 		Transport: &cacherTransport{
 			Session: m,
-			Base: &oauth2.Transport{
-				Source: m.oAuthConfig.TokenSource(context.Background(), m.token),
-			},
+			Base:    base,
 		},
 	}
 }
 
+// ensureHTTPClient returns the session's http.Client, lazily building one if
+// none exists yet.
+func (m *Session) ensureHTTPClient() *http.Client {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.httpClient == nil {
+		m.httpClient = m.newHTTPClient()
+	}
+	return m.httpClient
+}
+
 // SetToken sets the token to use for the session
 func (m *Session) SetToken(token *oauth2.Token) {
 	m.mutex.Lock()
@@ -177,132 +254,159 @@ func (m *Session) SaveToken() error {
 
 // GetRatelimit returns the current ratelimit information obtained by the last API request
 func (m *Session) GetRatelimit() Ratelimit {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
 	return m.ratelimit
 }
 
-// makeRequest creates a new request to a given url using given
-// OAuth token of an user
-func (m *Session) makeRequest(url string) ([]byte, error) {
-	// if httpClient is nil build a new one
-	if m.httpClient == nil {
-		m.httpClient = m.newHTTPClient()
-	}
+// Do fires a single request to url, lazily building the session's OAuth
+// http.Client (honoring Config.HTTPClient as its base) and applying the
+// standard go-fitbit headers. extraHeaders, if given, are set after the
+// standard headers and may override them. Callers needing retry behavior
+// should use makeRequest/makePOSTRequest/makeDELETERequest instead.
+func (m *Session) Do(ctx context.Context, method, url string, body io.Reader, extraHeaders ...map[string]string) (*http.Response, error) {
+	client := m.ensureHTTPClient()
 
-	// Build request
-	req, err := http.NewRequest("GET", url, nil)
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
 	if err != nil {
 		return nil, err
 	}
-
-	// Set custom header
 	req.Header.Set("User-Agent", "go-fitbit")
 	req.Header.Set("Accept-Language", "de_DE")
 	req.Header.Set("Accept-Locale", "de_DE")
-
-	// Fire request
-	response, err := m.httpClient.Do(req)
-	if err != nil {
-		return nil, err
+	if method == http.MethodPost {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	for _, set := range extraHeaders {
+		for key, value := range set {
+			req.Header.Set(key, value)
+		}
 	}
-	defer response.Body.Close()
-
-	// Parse rate limit headers
-	m.parseRatelimit(&response.Header)
 
-	// Read all data from request
-	contents, err := ioutil.ReadAll(response.Body)
+	response, err := client.Do(req)
 	if err != nil {
 		return nil, err
 	}
+	m.parseRatelimit(&response.Header)
+	return response, nil
+}
 
-	return contents, nil
+// makeRequest creates a new request to a given url using given
+// OAuth token of an user. It retries on 429/5xx responses, honoring
+// Retry-After and the Fitbit rate-limit headers, until ctx is done or
+// MaxRetries is exhausted. The returned int is the status code of the last
+// attempted response.
+func (m *Session) makeRequest(ctx context.Context, url string) ([]byte, int, error) {
+	return m.doWithRetry(ctx, http.MethodGet, url, nil, nil)
 }
 
 // makePOSTRequest creates a new request to a given url using given
-// OAuth token of an user
-func (m *Session) makePOSTRequest(targetURL string, param map[string]string) ([]byte, error) {
-	// if httpClient is nil build a new one
-	if m.httpClient == nil {
-		m.httpClient = m.newHTTPClient()
-	}
-
-	// Build post params
+// OAuth token of an user. See makeRequest for retry behavior.
+func (m *Session) makePOSTRequest(ctx context.Context, targetURL string, param map[string]string) ([]byte, int, error) {
 	form := url.Values{}
 	for name, value := range param {
 		form.Add(name, value)
 	}
+	encoded := form.Encode()
 
-	// Build request
-	req, err := http.NewRequest("POST", targetURL, strings.NewReader(form.Encode()))
-	if err != nil {
-		return nil, err
-	}
+	return m.doWithRetry(ctx, http.MethodPost, targetURL, func() io.Reader {
+		return strings.NewReader(encoded)
+	}, nil)
+}
 
-	// Set custom header
-	req.Header.Set("User-Agent", "go-fitbit")
-	req.Header.Set("Accept-Language", "de_DE")
-	req.Header.Set("Accept-Locale", "de_DE")
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+// makeDELETERequest creates a new request to a given url using given
+// OAuth token of an user. See makeRequest for retry behavior.
+func (m *Session) makeDELETERequest(ctx context.Context, url string) ([]byte, int, error) {
+	return m.doWithRetry(ctx, http.MethodDelete, url, nil, nil)
+}
 
-	// Fire request
-	response, err := m.httpClient.Do(req)
-	if err != nil {
-		return nil, err
+// doWithRetry fires method/url through Do, retrying on 429/5xx responses up
+// to Session.MaxRetries times. newBody, when non-nil, is called before every
+// attempt to get a fresh request body reader. extraHeaders, when non-nil, is
+// applied to every attempt via Do. It returns the body and status code of
+// the last attempted response.
+func (m *Session) doWithRetry(ctx context.Context, method, url string, newBody func() io.Reader, extraHeaders map[string]string) ([]byte, int, error) {
+	maxRetries := m.MaxRetries
+	if maxRetries < 0 {
+		maxRetries = defaultMaxRetries
+	}
+	baseDelay := m.RetryBaseDelay
+	if baseDelay < 0 {
+		baseDelay = defaultRetryBaseDelay
 	}
-	defer response.Body.Close()
 
-	// Parse rate limit headers
-	m.parseRatelimit(&response.Header)
+	var status int
+	for attempt := 0; ; attempt++ {
+		var body io.Reader
+		if newBody != nil {
+			body = newBody()
+		}
 
-	// Read all data from request
-	contents, err := ioutil.ReadAll(response.Body)
-	if err != nil {
-		return nil, err
-	}
+		response, err := m.Do(ctx, method, url, body, extraHeaders)
+		if err != nil {
+			return nil, status, err
+		}
+		status = response.StatusCode
 
-	return contents, nil
-}
+		contents, err := ioutil.ReadAll(response.Body)
+		response.Body.Close()
+		if err != nil {
+			return nil, status, err
+		}
 
-// makeDELETERequest creates a new request to a given url using given
-// OAuth token of an user
-func (m *Session) makeDELETERequest(url string) ([]byte, error) {
-	// if httpClient is nil build a new one
-	if m.httpClient == nil {
-		m.httpClient = m.newHTTPClient()
-	}
+		if !isRetryableStatus(status) || attempt >= maxRetries {
+			return contents, status, nil
+		}
 
-	// Build request
-	req, err := http.NewRequest("DELETE", url, nil)
-	if err != nil {
-		return nil, err
+		delay := m.retryDelay(&response.Header, attempt, baseDelay)
+		select {
+		case <-ctx.Done():
+			return contents, status, ctx.Err()
+		case <-time.After(delay):
+		}
 	}
+}
 
-	// Set custom header
-	req.Header.Set("User-Agent", "go-fitbit")
-	req.Header.Set("Accept-Language", "de_DE")
-	req.Header.Set("Accept-Locale", "de_DE")
+// isRetryableStatus reports whether a response status warrants a retry.
+func isRetryableStatus(status int) bool {
+	return status == http.StatusTooManyRequests || status >= http.StatusInternalServerError
+}
 
-	// Fire request
-	response, err := m.httpClient.Do(req)
-	if err != nil {
-		return nil, err
+// retryDelay determines how long to wait before the next retry attempt,
+// preferring Retry-After, then the fitbit-rate-limit-reset header when the
+// quota is exhausted, and falling back to exponential backoff with jitter.
+func (m *Session) retryDelay(header *http.Header, attempt int, baseDelay time.Duration) time.Duration {
+	if retryAfter := header.Get("Retry-After"); retryAfter != "" {
+		if secs, err := strconv.Atoi(retryAfter); err == nil {
+			return time.Duration(secs) * time.Second
+		}
 	}
-	defer response.Body.Close()
 
-	// Parse rate limit headers
-	m.parseRatelimit(&response.Header)
+	m.mutex.RLock()
+	rateLimitUsed := m.ratelimit.RateLimitUsed
+	m.mutex.RUnlock()
 
-	// Read all data from request
-	contents, err := ioutil.ReadAll(response.Body)
-	if err != nil {
-		return nil, err
+	if rateLimitUsed == 0 {
+		if reset := header.Get("fitbit-rate-limit-reset"); reset != "" {
+			if secs, err := strconv.Atoi(reset); err == nil {
+				return time.Duration(secs) * time.Second
+			}
+		}
 	}
 
-	return contents, nil
+	backoff := baseDelay * time.Duration(1<<uint(attempt))
+	if baseDelay <= 0 {
+		return backoff
+	}
+	jitter := time.Duration(rand.Int63n(int64(baseDelay)))
+	return backoff + jitter
 }
 
 // parseRatelimit parses the rate limit headers of fitbit API
 func (m *Session) parseRatelimit(header *http.Header) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
 	// Get rate limit data of request
 	// fist header returns the remaining API requests until reset time is reached
 	rateLimitData := header.Get("fitbit-rate-limit-remaining")
@@ -333,3 +437,33 @@ func (m *Session) Exchange(code string) (*oauth2.Token, error) {
 	m.SetToken(token)
 	return token, nil
 }
+
+// ExchangeRequest recovers the userID and state signature from an OAuth
+// redirect request built with LoginURLFor, verifies the signature in
+// constant time, and exchanges the authorization code on success.
+func (m *Session) ExchangeRequest(ctx context.Context, r *http.Request) (string, *oauth2.Token, error) {
+	query := r.URL.Query()
+	state := query.Get("state")
+	code := query.Get("code")
+
+	parts := strings.SplitN(state, "|", 2)
+	if len(parts) != 2 {
+		return "", nil, errInvalidState
+	}
+	decoded, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", nil, errInvalidState
+	}
+	userID := string(decoded)
+
+	if !hmac.Equal([]byte(m.signState(userID)), []byte(state)) {
+		return "", nil, errInvalidState
+	}
+
+	token, err := m.oAuthConfig.Exchange(ctx, code)
+	if err != nil {
+		return "", nil, err
+	}
+	m.SetToken(token)
+	return userID, token, nil
+}
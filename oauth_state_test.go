@@ -0,0 +1,63 @@
+package fitbit
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestExchangeRequestRejectsForgedState(t *testing.T) {
+	s := New(Config{ClientID: "id", ClientSecret: "secret"})
+
+	valid := s.signState("user-42")
+	forged := valid[:len(valid)-1] + "0" // replace the last hex digit of the signature
+
+	req := httptest.NewRequest(http.MethodGet, "/callback?state="+url.QueryEscape(forged)+"&code=abc", nil)
+	if _, _, err := s.ExchangeRequest(context.Background(), req); err != errInvalidState {
+		t.Fatalf("expected errInvalidState for a forged signature, got %v", err)
+	}
+}
+
+func TestExchangeRequestRejectsTruncatedState(t *testing.T) {
+	s := New(Config{ClientID: "id", ClientSecret: "secret"})
+
+	req := httptest.NewRequest(http.MethodGet, "/callback?state=missing-the-delimiter&code=abc", nil)
+	if _, _, err := s.ExchangeRequest(context.Background(), req); err != errInvalidState {
+		t.Fatalf("expected errInvalidState for a truncated state, got %v", err)
+	}
+}
+
+func TestExchangeRequestRejectsUserIDContainingDelimiter(t *testing.T) {
+	s := New(Config{ClientID: "id", ClientSecret: "secret"})
+
+	// A naive "userID|signature" scheme would mis-split a userID containing
+	// the delimiter; base64-encoding userID in signState prevents that, but
+	// an attacker handing back a state with a raw, un-encoded "|" in the
+	// first segment must still fail verification rather than authenticate.
+	req := httptest.NewRequest(http.MethodGet, "/callback?state="+url.QueryEscape("user|with|pipes|deadbeef")+"&code=abc", nil)
+	if _, _, err := s.ExchangeRequest(context.Background(), req); err != errInvalidState {
+		t.Fatalf("expected errInvalidState for an unsigned userID containing the delimiter, got %v", err)
+	}
+}
+
+func TestExchangeRequestAcceptsValidSignedState(t *testing.T) {
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer tokenServer.Close()
+
+	s := New(Config{ClientID: "id", ClientSecret: "secret"})
+	s.oAuthConfig.Endpoint.TokenURL = tokenServer.URL
+
+	state := s.signState("user-42")
+	req := httptest.NewRequest(http.MethodGet, "/callback?state="+url.QueryEscape(state)+"&code=abc", nil)
+
+	// The fake token endpoint always rejects the code exchange, so this can
+	// only return something other than errInvalidState if state verification
+	// itself passed first.
+	if _, _, err := s.ExchangeRequest(context.Background(), req); err == errInvalidState {
+		t.Fatal("a validly signed state was rejected during signature verification")
+	}
+}
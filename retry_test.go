@@ -0,0 +1,158 @@
+package fitbit
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDoWithRetryHonorsMaxRetriesZero(t *testing.T) {
+	var attempts int32
+	s := newTestSession(roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		atomic.AddInt32(&attempts, 1)
+		return &http.Response{
+			StatusCode: http.StatusInternalServerError,
+			Body:       ioutil.NopCloser(strings.NewReader("")),
+			Header:     make(http.Header),
+		}, nil
+	}))
+	s.MaxRetries = 0
+	s.RetryBaseDelay = time.Millisecond
+
+	if _, status, err := s.doWithRetry(context.Background(), http.MethodGet, "https://api.fitbit.com/x", nil, nil); err != nil || status != http.StatusInternalServerError {
+		t.Fatalf("got status %d, err %v", status, err)
+	}
+	if got := atomic.LoadInt32(&attempts); got != 1 {
+		t.Fatalf("expected MaxRetries=0 to fire exactly one attempt, got %d", got)
+	}
+}
+
+func TestDoWithRetryNegativeMaxRetriesFallsBackToDefault(t *testing.T) {
+	var attempts int32
+	s := newTestSession(roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		atomic.AddInt32(&attempts, 1)
+		return &http.Response{
+			StatusCode: http.StatusInternalServerError,
+			Body:       ioutil.NopCloser(strings.NewReader("")),
+			Header:     make(http.Header),
+		}, nil
+	}))
+	s.MaxRetries = -1
+	s.RetryBaseDelay = time.Millisecond
+
+	if _, _, err := s.doWithRetry(context.Background(), http.MethodGet, "https://api.fitbit.com/x", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := atomic.LoadInt32(&attempts); got != defaultMaxRetries+1 {
+		t.Fatalf("expected a negative MaxRetries to fall back to defaultMaxRetries (%d attempts), got %d", defaultMaxRetries+1, got)
+	}
+}
+
+func TestDoWithRetrySucceedsAfterTransientFailures(t *testing.T) {
+	var attempts int32
+	s := newTestSession(roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		if atomic.AddInt32(&attempts, 1) < 3 {
+			return &http.Response{
+				StatusCode: http.StatusServiceUnavailable,
+				Body:       ioutil.NopCloser(strings.NewReader("")),
+				Header:     make(http.Header),
+			}, nil
+		}
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       ioutil.NopCloser(strings.NewReader("ok")),
+			Header:     make(http.Header),
+		}, nil
+	}))
+	s.RetryBaseDelay = time.Millisecond
+
+	body, status, err := s.doWithRetry(context.Background(), http.MethodGet, "https://api.fitbit.com/x", nil, nil)
+	if err != nil || status != http.StatusOK || string(body) != "ok" {
+		t.Fatalf("got body %q, status %d, err %v", body, status, err)
+	}
+	if got := atomic.LoadInt32(&attempts); got != 3 {
+		t.Fatalf("expected 3 attempts before success, got %d", got)
+	}
+}
+
+func TestDoWithRetryStopsOnCtxCancellationDuringBackoff(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := newTestSession(roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		cancel()
+		return &http.Response{
+			StatusCode: http.StatusServiceUnavailable,
+			Body:       ioutil.NopCloser(strings.NewReader("")),
+			Header:     make(http.Header),
+		}, nil
+	}))
+	s.RetryBaseDelay = time.Second
+
+	_, _, err := s.doWithRetry(ctx, http.MethodGet, "https://api.fitbit.com/x", nil, nil)
+	if err != context.Canceled {
+		t.Fatalf("expected context.Canceled once ctx is done mid-backoff, got %v", err)
+	}
+}
+
+func TestRetryDelayUsesRetryAfterHeader(t *testing.T) {
+	s := newTestSession(nil)
+	header := &http.Header{}
+	header.Set("Retry-After", "7")
+
+	if got := s.retryDelay(header, 0, time.Millisecond); got != 7*time.Second {
+		t.Fatalf("expected Retry-After to take priority, got %v", got)
+	}
+}
+
+func TestRetryDelayFallsBackToRateLimitResetWhenQuotaExhausted(t *testing.T) {
+	s := newTestSession(nil)
+	s.mutex.Lock()
+	s.ratelimit.RateLimitUsed = 0
+	s.mutex.Unlock()
+
+	header := &http.Header{}
+	header.Set("fitbit-rate-limit-reset", "42")
+
+	if got := s.retryDelay(header, 0, time.Millisecond); got != 42*time.Second {
+		t.Fatalf("expected fitbit-rate-limit-reset fallback when quota is exhausted, got %v", got)
+	}
+}
+
+func TestRetryDelayIgnoresRateLimitResetWhenQuotaRemains(t *testing.T) {
+	s := newTestSession(nil)
+	s.mutex.Lock()
+	s.ratelimit.RateLimitUsed = 10
+	s.mutex.Unlock()
+
+	header := &http.Header{}
+	header.Set("fitbit-rate-limit-reset", "42")
+
+	if got := s.retryDelay(header, 0, time.Millisecond); got == 42*time.Second {
+		t.Fatal("expected fitbit-rate-limit-reset to be ignored while quota remains")
+	}
+}
+
+func TestRetryDelayExponentialBackoffWithJitterBounds(t *testing.T) {
+	s := newTestSession(nil)
+	base := 10 * time.Millisecond
+	header := &http.Header{}
+
+	for attempt, want := range map[int]time.Duration{0: base, 1: 2 * base, 2: 4 * base} {
+		got := s.retryDelay(header, attempt, base)
+		if got < want || got >= want+base {
+			t.Fatalf("attempt %d: expected delay in [%v, %v), got %v", attempt, want, want+base, got)
+		}
+	}
+}
+
+func TestRetryDelayZeroBaseDelayDoesNotPanic(t *testing.T) {
+	s := newTestSession(nil)
+	header := &http.Header{}
+
+	if got := s.retryDelay(header, 0, 0); got != 0 {
+		t.Fatalf("expected a zero base delay to produce no backoff or jitter, got %v", got)
+	}
+}
@@ -0,0 +1,103 @@
+package fitbit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// Subscription describes a Fitbit API subscription as returned by the
+// subscriptions endpoints.
+type Subscription struct {
+	CollectionType string `json:"collectionType"`
+	SubscriberID   string `json:"subscriberId"`
+	SubscriptionID string `json:"subscriptionId"`
+	OwnerID        string `json:"ownerId"`
+	OwnerType      string `json:"ownerType"`
+}
+
+// subscriptionsResponse mirrors the wrapper object returned by the list endpoint.
+type subscriptionsResponse struct {
+	APISubscriptions []Subscription `json:"apiSubscriptions"`
+}
+
+// Subscribe creates a subscription for the given collection so that Fitbit
+// notifies subscriberID's registered webhook of changes. A 409 response
+// (the user is already subscribed) is treated as success.
+func (m *Session) Subscribe(ctx context.Context, collection, subscriberID, subscriptionID string) error {
+	status, _, err := m.subscriptionRequest(ctx, http.MethodPost, subscriptionURL(collection, subscriptionID), subscriberID)
+	if err != nil {
+		return err
+	}
+	if status == http.StatusConflict {
+		// already subscribed, nothing to do
+		return nil
+	}
+	if status < 200 || status >= 300 {
+		return fmt.Errorf("fitbit: subscribe to %s failed with status %d", collection, status)
+	}
+	return nil
+}
+
+// Unsubscribe removes a single subscription previously created with Subscribe.
+func (m *Session) Unsubscribe(ctx context.Context, collection, subscriberID, subscriptionID string) error {
+	status, _, err := m.subscriptionRequest(ctx, http.MethodDelete, subscriptionURL(collection, subscriptionID), subscriberID)
+	if err != nil {
+		return err
+	}
+	if status < 200 || status >= 300 {
+		return fmt.Errorf("fitbit: unsubscribe from %s failed with status %d", collection, status)
+	}
+	return nil
+}
+
+// UnsubscribeAll lists every subscription for collection and removes them one
+// by one. It stops and returns the first error encountered.
+func (m *Session) UnsubscribeAll(ctx context.Context, collection string) error {
+	subscriptions, err := m.ListSubscriptions(ctx, collection)
+	if err != nil {
+		return err
+	}
+	for _, sub := range subscriptions {
+		if err := m.Unsubscribe(ctx, collection, sub.SubscriberID, sub.SubscriptionID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ListSubscriptions returns every subscription currently registered for collection.
+func (m *Session) ListSubscriptions(ctx context.Context, collection string) ([]Subscription, error) {
+	url := fmt.Sprintf("https://api.fitbit.com/1/user/-/%s/apiSubscriptions.json", collection)
+	status, body, err := m.subscriptionRequest(ctx, http.MethodGet, url, "")
+	if err != nil {
+		return nil, err
+	}
+	if status < 200 || status >= 300 {
+		return nil, fmt.Errorf("fitbit: list subscriptions for %s failed with status %d", collection, status)
+	}
+	var parsed subscriptionsResponse
+	if err := json.Unmarshal(body, &parsed); err != nil {
+		return nil, err
+	}
+	return parsed.APISubscriptions, nil
+}
+
+// subscriptionURL builds the per-subscription endpoint used to create and delete subscriptions.
+func subscriptionURL(collection, subscriptionID string) string {
+	return fmt.Sprintf("https://api.fitbit.com/1/user/-/%s/apiSubscriptions/%s.json", collection, subscriptionID)
+}
+
+// subscriptionRequest fires a subscription API request through doWithRetry,
+// so subscription calls get the same 429/5xx retry and backoff protection as
+// the rest of the API surface, and returns the response status and body.
+func (m *Session) subscriptionRequest(ctx context.Context, method, url, subscriberID string) (int, []byte, error) {
+	var headers map[string]string
+	if subscriberID != "" {
+		headers = map[string]string{"X-Fitbit-Subscriber-Id": subscriberID}
+	}
+
+	contents, status, err := m.doWithRetry(ctx, method, url, nil, headers)
+	return status, contents, err
+}
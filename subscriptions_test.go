@@ -0,0 +1,59 @@
+package fitbit
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"golang.org/x/oauth2"
+)
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func newTestSession(rt http.RoundTripper) *Session {
+	s := New(Config{ClientID: "id", ClientSecret: "secret", HTTPClient: &http.Client{Transport: rt}})
+	s.SetToken(&oauth2.Token{AccessToken: "token"})
+	return s
+}
+
+func TestSubscribeTreatsConflictAsSuccess(t *testing.T) {
+	s := newTestSession(roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: http.StatusConflict,
+			Body:       ioutil.NopCloser(strings.NewReader("")),
+			Header:     make(http.Header),
+		}, nil
+	}))
+
+	if err := s.Subscribe(context.Background(), "activities", "subscriber-1", "sub-id"); err != nil {
+		t.Fatalf("expected a 409 response to be treated as success, got error: %v", err)
+	}
+}
+
+func TestSubscribeReturnsErrorForOtherFailures(t *testing.T) {
+	var attempts int32
+	s := newTestSession(roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		atomic.AddInt32(&attempts, 1)
+		return &http.Response{
+			StatusCode: http.StatusInternalServerError,
+			Body:       ioutil.NopCloser(strings.NewReader("")),
+			Header:     make(http.Header),
+		}, nil
+	}))
+	s.MaxRetries = 0 // explicitly disable retries; must not be reinterpreted as "unset"
+
+	if err := s.Subscribe(context.Background(), "activities", "subscriber-1", "sub-id"); err == nil {
+		t.Fatal("expected a non-409 failure status to return an error")
+	}
+
+	if got := atomic.LoadInt32(&attempts); got != 1 {
+		t.Fatalf("expected MaxRetries=0 to fire exactly one attempt, got %d", got)
+	}
+}
@@ -0,0 +1,115 @@
+package fitbit
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+)
+
+// Notification describes a single entry of a Fitbit subscriber notification delivery.
+type Notification struct {
+	CollectionType string `json:"collectionType"`
+	Date           string `json:"date"`
+	OwnerID        string `json:"ownerId"`
+	OwnerType      string `json:"ownerType"`
+	SubscriptionID string `json:"subscriptionId"`
+}
+
+// Webhook implements Fitbit's subscriber notification protocol: the
+// verification handshake performed once when a subscriber URL is registered,
+// and the signed notification deliveries that follow afterwards.
+type Webhook struct {
+	// ClientSecret is used to derive the signing key for X-Fitbit-Signature.
+	ClientSecret string
+
+	// VerificationCode must match the verify query parameter Fitbit sends
+	// during the subscriber verification handshake.
+	VerificationCode string
+
+	// Handler is called with the notifications contained in a verified delivery.
+	Handler func(ctx context.Context, notifications []Notification) error
+}
+
+// ServeHTTP implements http.Handler so a Webhook can be registered directly
+// on an http.ServeMux.
+func (w *Webhook) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.serveVerification(rw, r)
+	case http.MethodPost:
+		w.serveNotification(rw, r)
+	default:
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// serveVerification answers Fitbit's subscriber verification handshake.
+func (w *Webhook) serveVerification(rw http.ResponseWriter, r *http.Request) {
+	verify := r.URL.Query().Get("verify")
+	if verify == "" || verify != w.VerificationCode {
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// serveNotification verifies the X-Fitbit-Signature header and dispatches the
+// delivered notifications to Handler.
+func (w *Webhook) serveNotification(rw http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if !w.verifySignature(body, r.Header.Get("X-Fitbit-Signature")) {
+		rw.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	var notifications []Notification
+	if err := json.Unmarshal(body, &notifications); err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if w.Handler != nil {
+		if err := w.Handler(r.Context(), notifications); err != nil {
+			rw.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// verifySignature checks body against the HMAC-SHA1 signature Fitbit sent in
+// the X-Fitbit-Signature header. Fitbit signs with the OAuth1-style key
+// clientSecret + "&" and base64-encodes the result; some older deliveries
+// URL-escape that base64 value, so both forms are accepted.
+func (w *Webhook) verifySignature(body []byte, signature string) bool {
+	if signature == "" {
+		return false
+	}
+
+	mac := hmac.New(sha1.New, []byte(w.ClientSecret+"&"))
+	mac.Write(body)
+	expected := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+
+	if hmac.Equal([]byte(expected), []byte(signature)) {
+		return true
+	}
+
+	if unescaped, err := url.QueryUnescape(signature); err == nil {
+		if hmac.Equal([]byte(expected), []byte(unescaped)) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,54 @@
+package fitbit
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"net/url"
+	"testing"
+)
+
+func signedNotificationBody(secret string, body []byte) string {
+	mac := hmac.New(sha1.New, []byte(secret+"&"))
+	mac.Write(body)
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestWebhookVerifySignatureValid(t *testing.T) {
+	w := &Webhook{ClientSecret: "shh"}
+	body := []byte(`[{"collectionType":"activities"}]`)
+
+	if !w.verifySignature(body, signedNotificationBody(w.ClientSecret, body)) {
+		t.Fatal("expected a correctly signed body to verify")
+	}
+}
+
+func TestWebhookVerifySignatureTamperedRejected(t *testing.T) {
+	w := &Webhook{ClientSecret: "shh"}
+	body := []byte(`[{"collectionType":"activities"}]`)
+	sig := signedNotificationBody(w.ClientSecret, body)
+
+	tampered := append([]byte(nil), body...)
+	tampered = append(tampered, ' ')
+	if w.verifySignature(tampered, sig) {
+		t.Fatal("expected a tampered body to be rejected")
+	}
+
+	if w.verifySignature(body, "garbage-signature") {
+		t.Fatal("expected a garbage signature to be rejected")
+	}
+
+	if w.verifySignature(body, "") {
+		t.Fatal("expected an empty signature to be rejected")
+	}
+}
+
+func TestWebhookVerifySignatureURLEscapedFallback(t *testing.T) {
+	w := &Webhook{ClientSecret: "shh"}
+	body := []byte(`[{"collectionType":"activities"}]`)
+	sig := signedNotificationBody(w.ClientSecret, body)
+
+	if !w.verifySignature(body, url.QueryEscape(sig)) {
+		t.Fatal("expected the URL-escaped signature variant to verify via the fallback path")
+	}
+}